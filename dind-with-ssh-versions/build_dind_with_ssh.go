@@ -1,33 +1,48 @@
 package main
 
 import (
-	"sort"
-	"strings"
-	"fmt"
-	"net/http"
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"crypto/tls"
 	"log"
-        "os"
-        "os/exec"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/lenoyavidan/dockerfiles/dind-with-ssh-versions/internal/apt"
 )
 
 /*
  * This go file is made to use the http://apt.dockerproject.org/ to get different available versions of
- * docker-engine. It also needs access to https://raw.githubusercontent.com/lenoyavidan/dockerfiles/master/dind-with-ssh-jenkins/Dockerfile 
+ * docker-engine. It also needs access to https://raw.githubusercontent.com/lenoyavidan/dockerfiles/master/dind-with-ssh-jenkins/Dockerfile
  * to get a Dockerfile used to build with and it needs access to a dockerhub namespace and repo to get tags from and push images to.
  * The files jenkins-slave-startup.sh and wrapdocker are also needed for this to run
  *
  * When run, tags from the specified dockerhub namespace/repo will be taken to check to see which versions
  * of docker-engine have been built. These will be used to check against the available versions from apt.dockerproject.org
- * to see if any of the available versions have not yet been built and pushed to the repo. If there is at least
- * one version that hasn't been built, the Dockerfile will be changed to build that version and it will be built/pushed
- * to the namespace/repo. If there are multiple versions to be built, it will only build on at a time. In other words
- * every time you run this it will build only ONE version, so you must run it multiple times to build multiple versions.
- * 
- * NOTE: After running this, wait at least TEN minutes before running again. It takes time for the api call for getting 
- * tags to update properly, so if you run this again within ten minutes it will build and push the same version as last run
+ * to see if any of the available versions have not yet been built and pushed to the repo. Versions are ordered with
+ * semver, so every missing version found is built and pushed in a single run instead of requiring the user
+ * to re-run the program once per version.
  *
  * There are 5 environmental variables that must be set for this to run correctly
  * 1. VERSION_TYPE: main, testing or experimental
@@ -35,24 +50,42 @@ import (
  * 3. REPO: the proper dockerhub repo
  * 4. PASSWORD: the password for your dockerhub namespace
  * 5. EMAIL: the email account for your dockerhub namespace
- * There is also an optional 6th variable that must be unset if it isn't going to be used
- * 6. VERSION_NUMBER: the specific version of the specified VERSION_TYPE that will be built if available
+ * There are also 3 optional variables that narrow down which of the missing versions get built. Any combination of
+ * them can be set; each unset one is simply not applied as a filter
+ * 6. FROM: "HEAD-N" to only build the N most recent missing versions
+ * 7. TO: a specific version to use as an inclusive upper bound
+ * 8. CONSTRAINT: a semver constraint, e.g. ">=1.10, <2.0"
+ *
+ * Missing versions are built concurrently, one goroutine per version, up to -build-concurrency
+ * at a time (see flags below). Each build gets its own context directory under -tmp so concurrent
+ * builds never share files, and pushes are serialized so Hub never sees more than one at a time.
  */
 
+var (
+	buildConcurrency = flag.Int("build-concurrency", runtime.NumCPU(), "number of docker-engine versions to build at once")
+	tmpDir           = flag.String("tmp", "tmp", "directory under which per-version build context directories are created")
+)
+
 var (
         name = os.Getenv("VERSION_TYPE") // type of version to get: main, testing or experimental
         namespace = os.Getenv("NAMESPACE") // name of hub namespace
         repo = os.Getenv("REPO") // name of hub repo
         password = os.Getenv("PASSWORD") // password for hub repo
         email = os.Getenv("EMAIL") // email for hub repo
-        vers = os.Getenv("VERSION_NUMBER") // specific version number
-	
-	tr = &http.Transport {
-		TLSClientConfig: &tls.Config {
-		InsecureSkipVerify: true,
-		},
-	}
-	client = &http.Client{Transport: tr} // creating a client to make api calls
+        from = os.Getenv("FROM") // optional: "HEAD-N" to only build the N most recent missing versions
+        to = os.Getenv("TO") // optional: inclusive upper bound version
+        constraintStr = os.Getenv("CONSTRAINT") // optional: a semver constraint, e.g. ">=1.10, <2.0"
+
+	httpClient = &http.Client{} // creating a client to make api calls
+
+	dockerfileURL = "https://raw.githubusercontent.com/lenoyavidan/dockerfiles/master/dind-with-ssh-jenkins/Dockerfile"
+	wrapdockerURL = "https://raw.githubusercontent.com/jpetazzo/dind/master/wrapdocker"
+
+	authURL     = "https://auth.docker.io/token"
+	registryURL = "https://registry-1.docker.io"
+
+	runCmd   = regexp.MustCompile(`(?m)^RUN curl.*$`)
+	linkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
 )
 
 // checks to make sure all environmental variables are set
@@ -74,163 +107,412 @@ func init() {
 	}
 }
 
-// type for the tags to be retrieved from docker hub
-type Tag struct {
-        Layer string `json:"layer"`
-	Name  string `json:"name"` // tag name
-}
-
-// changes value returned when printing tag value
-func (tag Tag) String() string {
-	return fmt.Sprintf("layer: %s, name: %s", tag.Layer, tag.Name)
+// response body of a Registry v2 tags/list call
+type tagsList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
 }
 
 /*
- * Searches through the given array of strings to see if the given string
- * is in the array
- * Parameter 1: an array of type string to be searched
- * Parameter 2: a value to search the array for
- * Return: If the value is found in the array, the index is returned. If it is not
- * found then -1 is returned
- * 
- * The function could be made more efficient by requiring the array
- * be sorted using sort.Strings before being passed in and then
- * performing a binary search rather than a linear search.
- * However, this would only be necessary for arrays that contained a hundred
- * strings or more since that is when the efficiency of the two methods begins to 
- * greatly diverge
+ * Strips the "-0~" Debian revision suffix apt adds and turns the "~" before a pre-release
+ * component (rc/dev builds) into the "-" semver expects, e.g. "1.10.0~rc1-0~trusty" becomes
+ * "1.10.0-rc1".
  */
-func FindString(str []string, val string) int {
-	for i, v := range str {
-		if v == val {
-			return i
-		} 
-	}
-	return -1
+func normalizeAptVersion(version string) string {
+	return strings.Replace(strings.Split(version, "-0")[0], "~", "-", 1)
 }
 
 /*
- * Takes in a string and searches through it to find the version number
- * Parameter: a string to be searched for the keyword "Version:"
- * Return: It will return a string of the version number, or if it doesn't
- * find the version number, the function returns an empty string ""
- *
- * This function is used to parse through the Packages file on the apt.dockerproject.org  
- * site for the most recent version of docker-engine
+ * Uses apt.ParsePackages to find the newest docker-engine version listed in the Packages file,
+ * ordering candidates with semver instead of relying on whichever stanza happens to come last.
+ * Return 1: A string of the latest version of docker-engine
+ * Return 2: An error that is nil if no error occured
  */
-func Version(str string) string {
-	strarr := strings.Fields(str)
-	for i, v := range strarr {
-		if strings.EqualFold(v, "Version:") { 
-			version := strarr[i + 1] // if the current string is "Version:" get the next string which should be the version number
-			return strings.Replace((strings.Split(version, "-0"))[0], "~", "-", 1) // get rid of unnecessary text and replace the tilda with a dash
+func NewestVersion() (str string, err error) {
+	resp, err := httpClient.Get(fmt.Sprintf("https://apt.dockerproject.org/repo/dists/ubuntu-trusty/%s/binary-amd64/Packages", name))
+	if err != nil { return }
+	defer resp.Body.Close()
+
+	packages, err := apt.ParsePackages(resp.Body)
+	if err != nil { return }
+
+	var newest *semver.Version
+	for _, p := range packages {
+		if p.Package != "docker-engine" {
+			continue
+		}
+		v, verr := semver.NewVersion(normalizeAptVersion(p.Version))
+		if verr != nil {
+			continue
 		}
+		if newest == nil || v.GreaterThan(newest) {
+			newest = v
+		}
+	}
+	if newest != nil {
+		str = newest.Original()
 	}
-        return ""
+	return
 }
 
 /*
- * This Function uses api calls and the Version function to get the latest version of docker-engine
- * Return 1: A string of the latest version of docker-engine
- * Return 2: An error that is nil if no error occured
+ * Gets a bearer token from Docker Hub's auth service good for pulling tags of the given
+ * namespace/repo. Uses Basic auth from NAMESPACE/PASSWORD when a password is set, which gives
+ * access to tags of private repos as well as public ones.
+ * Return 1: the bearer token
+ * Return 2: an error that is nil if no error occured
  */
-func NewestVersion() (str string, err error) {
-	resp, err := client.Get(fmt.Sprintf("https://apt.dockerproject.org/repo/dists/ubuntu-trusty/%s/binary-amd64/Packages", name))
+func registryToken() (token string, err error) {
+	url := fmt.Sprintf("%s?service=registry.docker.io&scope=repository:%s/%s:pull", authURL, namespace, repo)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil { return }
-	defer resp.Body.Close()
+	if password != "" {
+		req.SetBasicAuth(namespace, password)
+	}
 
-	contents, err := ioutil.ReadAll(resp.Body)
+	resp, err := httpClient.Do(req)
 	if err != nil { return }
-	str = Version(string(contents)) // call function to parse variable contents for the version
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("registry token request failed: %s", resp.Status)
+		return
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	token = body.Token
 	return
 }
 
 /*
- * Function uses api call to get tag names from given docker hub namespace and repo
+ * Parses the next page URL out of a Registry v2 "Link: <...>; rel=\"next\"" response header, as
+ * used by the tags/list endpoint for pagination. Returns "" once there are no more pages.
+ */
+func nextPageURL(link string) string {
+	m := linkNext.FindStringSubmatch(link)
+	if m == nil {
+		return ""
+	}
+	if strings.HasPrefix(m[1], "/") {
+		return registryURL + m[1]
+	}
+	return m[1]
+}
+
+/*
+ * Function uses the Registry v2 API to get tag names from given docker hub namespace and repo
  * Return 1: A slice of strings representing the tag names from the specifieddocker hub repo
  * Return 2: An error code that is nil if no error occured
  */
 func Tags() (list []string, err error) {
-        var tag []Tag
-        list = make([]string, 0)
-        resp2, err := client.Get(fmt.Sprintf("https://registry.hub.docker.com/v1/repositories/%s/%s/tags", namespace, repo))
+	list = make([]string, 0)
+
+	token, err := registryToken()
 	if err != nil { return }
-	defer resp2.Body.Close()
-	if err = json.NewDecoder(resp2.Body).Decode(&tag); err != nil { return }
 
-        for i := range tag { // go through array of tags to get the tag names and add them to an array
-                list = append(list, tag[i].Name) 
+	url := fmt.Sprintf("%s/v2/%s/%s/tags/list", registryURL, namespace, repo)
+	for url != "" {
+		req, rerr := http.NewRequest("GET", url, nil)
+		if rerr != nil { err = rerr; return }
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, rerr := httpClient.Do(req)
+		if rerr != nil { err = rerr; return }
+
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("tags/list request failed: %s", resp.Status)
+			resp.Body.Close()
+			return
+		}
+
+		var page tagsList
+		derr := json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if derr != nil { err = derr; return }
+		list = append(list, page.Tags...)
+
+		url = nextPageURL(resp.Header.Get("Link")) // follow pagination, if any
 	}
+
         sort.Strings(list) // sort the list of tag names
 	return
-} 
+}
 
 /*
- * Function that gets all the current versions available from apt.dockerproject.org 
+ * Function that gets all the current versions available from apt.dockerproject.org
  * site for the given build
  * Parameter: a string indicating which build to choose: main, testing or experimental
- * Return 1: A slice of strings containing all the versions of docker-engine available to build
- * Return 2: An error that is nil if no errors occured 
- * 
- * Currently there is no html parser, would be good to add if a stable version is created
+ * Return 1: A slice of semver.Version, oldest to newest, containing every version of docker-engine available to build
+ * (for experimental, only the newest available version)
+ * Return 2: An error that is nil if no errors occured
  */
-func AvailableVersions(build string) (versions []string, err error) {
-	versions = make([]string, 0)
-        resp3, err := client.Get(fmt.Sprintf("http://apt.dockerproject.org/repo/pool/%s/d/docker-engine/", build))
+func AvailableVersions(build string) (versions []*semver.Version, err error) {
+	versions = make([]*semver.Version, 0)
+        resp3, err := httpClient.Get(fmt.Sprintf("http://apt.dockerproject.org/repo/pool/%s/d/docker-engine/", build))
 	if err != nil { return }
-        defer resp3.Body.Close() 
-	text, err := ioutil.ReadAll(resp3.Body)
+        defer resp3.Body.Close()
+
+	debs, err := apt.ParsePool(resp3.Body)
 	if err != nil { return }
-	nums := strings.Fields(string(text))
-
-	for _, v := range nums {
-		if strings.Contains(v, "docker-engine_") { // only get strings that have the version number in it
-			value := (strings.Split((strings.Split(v, "_"))[1], "-"))[0] // split the the string out so that only the version is returned 
-			value = strings.Replace(value, "~", "-", 1)
-			if FindString(versions, value) < 0 { 
-				versions = append(versions, value) // if the version hasn't already been added, add it to the array
-			}
+
+	seen := make(map[string]bool)
+	for _, deb := range debs {
+		if deb.Name != "docker-engine" {
+			continue
+		}
+		value := normalizeAptVersion(deb.Version)
+		if seen[value] {
+			continue // if the version has already been added, skip it
 		}
+		seen[value] = true
+		ver, verr := semver.NewVersion(value)
+		if verr != nil {
+			continue // not a version we can order, ignore it
+		}
+		versions = append(versions, ver)
 	}
+	sort.Sort(semver.Collection(versions)) // oldest to newest
 
-	if name == "experimental" {
-		temp := make([]string, 0)
-		sort.Sort(sort.Reverse(sort.StringSlice(versions)))
-		temp = append(temp, versions[0])
-		versions = temp
+	if name == "experimental" && len(versions) > 0 {
+		versions = versions[len(versions)-1:] // experimental only ever tracks the newest available build
 	}
 	return
 }
 
 /*
- * Function that downloads the necessary Dockerfile and then changes it to build the image with the 
- * correct version of docker-engine. It then builds the image and returns the image name and tag in one string
- * Parameter: A string representing the version number to build
+ * selectVersions narrows the given not-yet-built versions (oldest to newest) down to the
+ * ones this run should actually build, applying the optional FROM/TO/CONSTRAINT environment
+ * variables. With none of them set, every version passed in is selected.
+ */
+func selectVersions(missing []*semver.Version) ([]*semver.Version, error) {
+	selected := missing
+
+	if constraintStr != "" {
+		constraint, err := semver.NewConstraint(constraintStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CONSTRAINT %q: %v", constraintStr, err)
+		}
+		filtered := make([]*semver.Version, 0, len(selected))
+		for _, v := range selected {
+			if constraint.Check(v) {
+				filtered = append(filtered, v)
+			}
+		}
+		selected = filtered
+	}
+
+	if to != "" {
+		upper, err := semver.NewVersion(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TO %q: %v", to, err)
+		}
+		filtered := make([]*semver.Version, 0, len(selected))
+		for _, v := range selected {
+			if v.Compare(upper) <= 0 {
+				filtered = append(filtered, v)
+			}
+		}
+		selected = filtered
+	}
+
+	if from != "" {
+		n, err := parseHeadN(from)
+		if err != nil {
+			return nil, err
+		}
+		if n < len(selected) {
+			selected = selected[len(selected)-n:]
+		}
+	}
+
+	return selected, nil
+}
+
+/*
+ * parseHeadN parses a "HEAD-N" string into N, e.g. "HEAD-3" -> 3.
+ */
+func parseHeadN(value string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(value, "HEAD-"))
+	if err != nil || !strings.HasPrefix(value, "HEAD-") || n <= 0 {
+		return 0, fmt.Errorf("invalid FROM %q: expected HEAD-N", value)
+	}
+	return n, nil
+}
+
+/*
+ * Fetches a URL over HTTP(S) and returns the body bytes. Used to pull the
+ * Dockerfile and wrapdocker script that the build context is assembled from.
+ */
+func fetch(url string) ([]byte, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+/*
+ * Writes the given named files into dir, creating it if necessary. Each concurrent build gets
+ * its own dir under -tmp so that builds running in parallel never share files on disk.
+ */
+func writeBuildContext(dir string, files map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Tars up the given build context directory into an in-memory archive, suitable for passing to
+ * ImageBuild.
+ * Parameter: the build context directory, as written by writeBuildContext
+ * Return 1: a reader over the tar archive
+ * Return 2: an error that is nil if no error occurred
+ */
+func tarBuildContext(dir string) (io.Reader, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		hdr := &tar.Header{
+			Name: entry.Name(),
+			Mode: 0644,
+			Size: int64(len(contents)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(contents); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+/*
+ * Rewrites the single "RUN curl ..." line in the Dockerfile so that it installs the already
+ * downloaded-and-verified docker-engine .deb via COPY instead of curling it inside the build
+ * (which had no integrity check on the result).
+ * Parameter 1: the raw Dockerfile contents
+ * Parameter 2: the name of the .deb file, as placed in the build context by BuildVersion
+ * Return: the rewritten Dockerfile contents
+ */
+func rewriteDockerfile(dockerfile []byte, debFile string) []byte {
+	replacement := strings.Join([]string{
+		fmt.Sprintf("ENV TYPE %s", name),
+		fmt.Sprintf("ENV DEB_FILE %s", debFile),
+		"COPY $DEB_FILE deb/$DEB_FILE",
+		"RUN dpkg -i deb/$DEB_FILE",
+	}, "\n")
+	return runCmd.ReplaceAll(dockerfile, []byte(replacement))
+}
+
+/*
+ * Looks up the Packages stanza for the given docker-engine version in the current channel, so
+ * its Filename/SHA256 can be used to fetch and verify the .deb before it goes into a build.
+ * Parameter: the (semver-normalized) docker-engine version to find
+ * Return 1: the matching Packages stanza
+ * Return 2: an error if the Packages file couldn't be fetched/parsed, or no stanza matched
+ */
+func lookupPackage(version string) (apt.Package, error) {
+	resp, err := httpClient.Get(fmt.Sprintf("https://apt.dockerproject.org/repo/dists/ubuntu-trusty/%s/binary-amd64/Packages", name))
+	if err != nil {
+		return apt.Package{}, err
+	}
+	defer resp.Body.Close()
+
+	packages, err := apt.ParsePackages(resp.Body)
+	if err != nil {
+		return apt.Package{}, err
+	}
+
+	for _, p := range packages {
+		if p.Package == "docker-engine" && normalizeAptVersion(p.Version) == version {
+			return p, nil
+		}
+	}
+	return apt.Package{}, fmt.Errorf("no Packages stanza found for docker-engine %s", version)
+}
+
+/*
+ * VerifyDeb hashes the file at path and compares it against wantSHA256, returning an error if
+ * they don't match. Used to catch a corrupted mirror or a MITM on the plain-HTTP apt.dockerproject.org
+ * before the .deb is ever handed to Docker.
+ */
+func VerifyDeb(path, wantSHA256 string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	got := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(got, wantSHA256) {
+		return fmt.Errorf("sha256 mismatch for %s: want %s, got %s", path, wantSHA256, got)
+	}
+	return nil
+}
+
+/*
+ * Function that downloads the necessary Dockerfile and then changes it to build the image with the
+ * correct version of docker-engine. It then builds the image using the Docker Engine API and returns
+ * the image name and tag in one string
+ * Parameter 1: A string representing the version number to build
+ * Parameter 2: The build context directory to write the Dockerfile, wrapdocker and verified .deb
+ * into; must be unique per concurrent call
  * Return 1: A string that contains the name of the built image and its corresponding tag ex: "bmangold/dind-with-ssh:1.8.0"
- * Return 2: An error that is nil if no error occurred 
+ * Return 2: An error that is nil if no error occurred
  */
-func BuildVersion(version string) (image string, err error) {
-	output, err := exec.Command("curl", "-sS", "https://raw.githubusercontent.com/lenoyavidan/dockerfiles/master/dind-with-ssh-jenkins/Dockerfile").CombinedOutput()
-	if err != nil { return }
-	dockerfile, err := os.Create("Dockerfile")
-	_, err = dockerfile.Write(output)
-	if err != nil { return }
-	
-	output, err = exec.Command("curl", "-sS", "https://raw.githubusercontent.com/jpetazzo/dind/master/wrapdocker").CombinedOutput()
-	if err != nil { return }
-	wrapdocker, err := os.Create("wrapdocker")
-	_, err = wrapdocker.Write(output)
-	if err != nil { return }
+func BuildVersion(version, buildDir string) (image string, err error) {
+	ctx := context.Background()
 
-	err = exec.Command("sed", "-i", fmt.Sprintf("/RUN curl/ i\\ENV TYPE %s", name), "Dockerfile").Run()
+	dockerfile, err := fetch(dockerfileURL)
 	if err != nil { return }
-	err = exec.Command("sed", "-i", fmt.Sprintf("/RUN curl/ i\\ENV DEB_FILE docker-engine_%s-0~trusty_amd64.deb", strings.Replace(version, "-", "~", 1)), "Dockerfile").Run()
+	wrapdocker, err := fetch(wrapdockerURL)
 	if err != nil { return }
-	err = exec.Command("sed", "-i", "/RUN curl/ c\\RUN curl -sS http://apt.dockerproject.org/repo/pool/$TYPE/d/docker-engine/$DEB_FILE > deb/$DEB_FILE", "Dockerfile").Run()
+
+	pkg, err := lookupPackage(version)
 	if err != nil { return }
-	err = exec.Command("sed", "-i", "/RUN curl/ i\\RUN mkdir deb", "Dockerfile").Run()
+	debFile := filepath.Base(pkg.Filename)
+
+	deb, err := fetch(fmt.Sprintf("http://apt.dockerproject.org/repo/%s", pkg.Filename))
 	if err != nil { return }
-	err = exec.Command("sed", "-i", "/RUN curl/ a\\RUN dpkg -i deb/$DEB_FILE", "Dockerfile").Run()
+
+	dockerfile = rewriteDockerfile(dockerfile, debFile)
+
+	if err = writeBuildContext(buildDir, map[string][]byte{
+		"Dockerfile": dockerfile,
+		"wrapdocker": wrapdocker,
+		debFile:      deb,
+	}); err != nil { return }
+
+	if err = VerifyDeb(filepath.Join(buildDir, debFile), pkg.SHA256); err != nil { return }
+
+	tarCtx, err := tarBuildContext(buildDir)
 	if err != nil { return }
 
 	// add something to change tag name for experimental versions since its name needs to be split so the proper tag name can be retrieved
@@ -241,15 +523,24 @@ func BuildVersion(version string) (image string, err error) {
 	} else {
 		image = fmt.Sprintf("%s/%s:%s", namespace, repo, version)
 	}
-	err = exec.Command("sudo", "docker", "build", "-t", image, ".").Run()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil { return }
 
+	resp, err := cli.ImageBuild(ctx, tarCtx, types.ImageBuildOptions{
+		Tags:       []string{image},
+		Dockerfile: "Dockerfile",
+	})
+	if err != nil { return }
+	defer resp.Body.Close()
+
+	err = jsonmessage.DisplayJSONMessagesStream(resp.Body, os.Stdout, os.Stdout.Fd(), false, nil)
 	return
 }
 
 /*
- * This function uses the docker run command to check that the image can run as a container and
- * that the version of docker it is running on matches the passed in version
+ * This function uses the Docker Engine API to run the built image as a container to check that it
+ * can run and that the version of docker it is running on matches the passed in version
  * Parameter: the string representing the name and tag of the image to be run and checked
  * Return 1: A boolean value that is true if the image built correctly and the versions match,
  * otherwise it is false
@@ -257,10 +548,39 @@ func BuildVersion(version string) (image string, err error) {
  */
 func BuildWorks(image string) (works bool, err error) {
 	works = false
-	output, err := exec.Command("sudo", "docker", "run", "--rm", "--privileged", "-e", "LOG=file", image, "bash", "-c", "(/usr/local/bin/wrapdocker &);sleep 5;docker version").CombinedOutput()
+	ctx := context.Background()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil { return }
 
-	arr := strings.Fields(string(output)) // divide up the output into an array of strings to get the individual string values to check with
+	created, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:      image,
+		Cmd:        []string{"bash", "-c", "(/usr/local/bin/wrapdocker &);sleep 5;docker version"},
+		Env:        []string{"LOG=file"},
+		Tty:        false,
+	}, &container.HostConfig{
+		Privileged: true,
+	}, nil, nil, "")
+	if err != nil { return }
+	defer cli.ContainerRemove(ctx, created.ID, types.ContainerRemoveOptions{Force: true})
+
+	if err = cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil { return }
+
+	statusCh, errCh := cli.ContainerWait(ctx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case err = <-errCh:
+		if err != nil { return }
+	case <-statusCh:
+	}
+
+	out, err := cli.ContainerLogs(ctx, created.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+	if err != nil { return }
+	defer out.Close()
+
+	var stdout bytes.Buffer
+	if _, err = stdcopy.StdCopy(&stdout, &stdout, out); err != nil { return }
+
+	arr := strings.Fields(stdout.String()) // divide up the output into an array of strings to get the individual string values to check with
 	for i, v := range arr {
 		if v == "Version:" || v == "version:" && (arr[i - 1] == "Server" || arr[i - 1] == "Client") { // the first test is for docker versions 1.8.0 and later, the rest of the tests are a work around to test the 1.7.0 and 1.7.1 versions
 			version := arr[i + 1]
@@ -270,12 +590,139 @@ func BuildWorks(image string) (works bool, err error) {
 				return false, nil
 			}
 		}
-	} 
+	}
 
 	return
 }
 
+/*
+ * Builds the base64-encoded AuthConfig JSON blob the Docker Engine API expects in the
+ * X-Registry-Auth header for ImagePush, using the NAMESPACE/PASSWORD/EMAIL that this
+ * tool requires on startup.
+ */
+func registryAuth() (string, error) {
+	authConfig := types.AuthConfig{
+		Username: namespace,
+		Password: password,
+		Email:    email,
+	}
+	encoded, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+/*
+ * Tags the given image under a new name/tag and pushes it to the configured docker hub
+ * namespace/repo, replacing the old "docker tag -f" + "docker push" shell-outs.
+ * Parameter 1: the source image name and tag
+ * Parameter 2: the destination image name and tag, empty to push the source image as-is
+ */
+func pushImage(image, retag string) error {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	target := image
+	if retag != "" {
+		if err := cli.ImageTag(ctx, image, retag); err != nil {
+			return err
+		}
+		target = retag
+	}
+
+	auth, err := registryAuth()
+	if err != nil {
+		return err
+	}
+
+	out, err := cli.ImagePush(ctx, target, types.ImagePushOptions{RegistryAuth: auth})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return jsonmessage.DisplayJSONMessagesStream(out, os.Stdout, os.Stdout.Fd(), false, nil)
+}
+
+// the outcome of building, testing and pushing a single docker-engine version
+type versionResult struct {
+	version string
+	status  string // "built", "failed" or "skipped" (already present in the repo)
+	err     error
+}
+
+/*
+ * Builds, smoke-tests and pushes a single docker-engine version. Safe to call concurrently for
+ * different versions: each call writes its build context under its own -tmp subdirectory, and
+ * pushMu is held for the duration of any push so concurrent builds never push at the same time.
+ * Parameter 1: the version to build
+ * Parameter 2: the newest known docker-engine version, used to decide whether to also push the
+ * "latest"/"rc-latest"/"dev-latest" tag
+ * Parameter 3: the mutex pushes are serialized behind
+ * Return: the outcome of the build, to be collected into the run's summary
+ */
+func buildOne(v *semver.Version, latest string, pushMu *sync.Mutex) versionResult {
+	raw := v.Original()
+	tag := raw
+	if name == "testing" && !strings.Contains(raw, "rc") {
+		tag += "-rc1"
+	}
+
+	fmt.Printf("building docker-engine version %s\n", raw)
+	buildDir := filepath.Join(*tmpDir, strings.NewReplacer("~", "_", ":", "_").Replace(raw))
+	defer os.RemoveAll(buildDir) // don't leave the Dockerfile/wrapdocker/.deb lying around after the build
+
+	image, err := BuildVersion(raw, buildDir) // build version
+	if err != nil {
+		return versionResult{raw, "failed", fmt.Errorf("build: %v", err)}
+	}
+
+	img := image
+	if tag != raw {
+		img = fmt.Sprintf("%s/%s:%s", namespace, repo, tag) // needed for when the version is in testing and doesn't have -rc#
+	}
+	works, err := BuildWorks(img) // returns true if image works and has correct docker version
+	if err != nil || !works {
+		return versionResult{raw, "failed", fmt.Errorf("image %s not built properly: %v", image, err)}
+	}
+	fmt.Printf("build succeeded for %s\n", raw)
+
+	pushMu.Lock()
+	defer pushMu.Unlock()
+
+	if raw == latest {
+		var retag string
+		if name == "main" {
+			retag = fmt.Sprintf("%s/%s:latest", namespace, repo)
+		} else if name == "testing" {
+			retag = fmt.Sprintf("%s/%s:rc-latest", namespace, repo)
+		} else if name == "experimental" {
+			retag = fmt.Sprintf("%s/%s:dev-latest", namespace, repo)
+		}
+		fmt.Printf("pushing %s as %s\n", image, retag)
+		if err = pushImage(image, retag); err != nil {
+			return versionResult{raw, "failed", fmt.Errorf("latest tag/push: %v", err)}
+		}
+	}
+
+	fmt.Printf("pushing docker-engine version %s to %s/%s\n", raw, namespace, repo)
+	if err = pushImage(image, ""); err != nil { // push the image
+		return versionResult{raw, "failed", fmt.Errorf("push: %v", err)}
+	}
+
+	return versionResult{raw, "built", nil}
+}
+
 func main() {
+	flag.Parse()
+
+	if *buildConcurrency < 1 {
+		log.Fatalf("-build-concurrency must be at least 1, got %d", *buildConcurrency)
+	}
 
     	latest, err := NewestVersion() // get the latest available version number of docker-engine from the package on the apt site
 	if err != nil {
@@ -297,96 +744,67 @@ func main() {
 	}
         fmt.Println()
 
-	versions, err := AvailableVersions(name) // get all versions from apt site that can be downloaded and built
+	versions, err := AvailableVersions(name) // get all versions from apt site that can be downloaded and built, oldest to newest
 	if err != nil {
 		fmt.Println("failed to get available versions")
 		log.Fatal(err)
 	}
 	fmt.Printf("available docker-engine versions are: %v\n", versions)
 
-	// if a specific version is specified to be built, set it up so it is the version to be built
-	if FindString(versions, vers) >= 0 {
-		versions[0] = vers
-	} else if vers != "" {
-		fmt.Printf("specified version %s not available to build\n", vers)
-		return
+	built := make(map[string]bool)
+	for _, t := range list {
+		built[t] = true
 	}
 
+	missing := make([]*semver.Version, 0)
+	results := make([]versionResult, 0, len(versions))
 	for _, v := range versions {
-		changed := "false"
-		if name == "testing" && !strings.Contains(v, "rc") {
-			changed = v
-			v += "-rc1"
+		raw := v.Original()
+		tag := raw
+		if name == "testing" && !strings.Contains(raw, "rc") {
+			tag += "-rc1"
 		}
-		// test to see if the version has already been built
-		// the second test in the if statement is for experimental since its string has to be handled differently
-		if FindString(list, v) < 0 && FindString(list, strings.Split(v, "~")[0]) < 0 {
-			fmt.Printf("logging in to %s\n", namespace)
-			err = exec.Command("sudo", "docker", "login", fmt.Sprintf("-u=%s", namespace), fmt.Sprintf("-p=%s", password), fmt.Sprintf("-e=%s", email)).Run()
-			if err != nil {
-				fmt.Println("login failed")
-				log.Fatal(err)
-			}
-			
-			fmt.Printf("building docker-engine version %s\n", v)
-			if changed != "false" {
-				v = changed
-			}
-			image, err := BuildVersion(v) // build version
-			if err != nil {
-				fmt.Println("build failed")
-				log.Fatal(err)
-			}
+		// the second test is for experimental since its string has to be handled differently
+		if built[tag] || built[strings.Split(tag, "~")[0]] {
+			results = append(results, versionResult{raw, "skipped", nil})
+			continue
+		}
+		missing = append(missing, v)
+	}
 
-			img := image
-			if changed != "false" { 
-				img = fmt.Sprintf("%s/%s:%s", namespace, repo, v) // needed for when the version is in testing and doesn't have -rc#
-			}
-			works, err := BuildWorks(img) // returns true if image works and has correct docker version
-			if err != nil || !works {
-				fmt.Printf("image %s not built properly\n", image)
-				log.Fatal(err)
-			}
-			fmt.Println("build succeeded")
-
-			if v == latest {
-				var retag string
-				if name == "main" {
-					retag = fmt.Sprintf("%s/%s:latest", namespace, repo)	
-					fmt.Printf("pushing latest to %s/%s\n", namespace, repo)
-				} else if name == "testing" {
-					retag = fmt.Sprintf("%s/%s:rc-latest", namespace, repo)	
-					fmt.Printf("pushing rc-latest to %s/%s\n", namespace, repo)
-				} else if name == "experimental" {
-					retag = fmt.Sprintf("%s/%s:dev-latest", namespace, repo)	
-					fmt.Printf("pushing dev-latest to %s/%s\n", namespace, repo)
-				}
-				err = exec.Command("sudo", "docker", "tag", "-f", image, retag).Run() // tag the image as a type of latest
-				if err != nil {
-					fmt.Println("latest tag failed")
-					log.Fatal(err)
-				}
-				err = exec.Command("sudo", "docker", "push", retag).Run() // tag the image as latest and push it as latest
-				if err != nil {
-					fmt.Println("latest push failed")
-					log.Fatal(err)
-				}
-			}
-			if name == "experimental" {
-				break
-			} 
-			fmt.Printf("pushing docker-engine version %s to %s/%s\n", v, namespace, repo)
-			err = exec.Command("sudo", "docker", "push", image).Run() // push the image
-			if err != nil {
-				fmt.Println("push failed")
-				log.Fatal(err)
-			}
-			break
-		} else {
-			fmt.Printf("version %s already built and pushed\n", v)
-			if vers != "" {
-				break
-			}
+	versions, err = selectVersions(missing) // narrow down by FROM/TO/CONSTRAINT, if set
+	if err != nil {
+		fmt.Println("failed to select versions to build")
+		log.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var pushMu sync.Mutex
+	sem := make(chan struct{}, *buildConcurrency)
+	buildResults := make([]versionResult, len(versions))
+
+	for i, v := range versions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, v *semver.Version) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			buildResults[i] = buildOne(v, latest, &pushMu)
+		}(i, v)
+	}
+	wg.Wait()
+	results = append(results, buildResults...)
+
+	fmt.Println("build summary:")
+	failed := false
+	for _, r := range results {
+		fmt.Printf("  %s: %s\n", r.version, r.status)
+		if r.err != nil {
+			fmt.Printf("    %v\n", r.err)
+			failed = true
 		}
-	} 
+	}
+	if failed {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,133 @@
+/*
+ * Package apt parses the two flavours of index this tool needs from
+ * apt.dockerproject.org: the RFC-822-style "Packages" file served under dists/,
+ * and the Apache-style HTML directory listing served under pool/. Both used
+ * to be scraped with strings.Fields and literal substring checks; this gives
+ * the rest of the tool structured types to work against instead.
+ */
+package apt
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// A single stanza of the Debian "Packages" index
+type Package struct {
+	Package  string
+	Version  string
+	Filename string
+	SHA256   string
+	Size     int64
+}
+
+// A .deb file found in a pool/ directory listing
+type DebFile struct {
+	Name    string // the package name, e.g. "docker-engine"
+	Version string
+	Arch    string
+}
+
+/*
+ * ParsePackages walks the blank-line-separated stanzas of a Debian "Packages" file. Each
+ * stanza is a set of "Key: value" lines, where a line beginning with whitespace is a
+ * continuation of the previous key's value. Every stanza is returned, not just the last one
+ * seen, so callers can pick the version they want instead of relying on file order.
+ */
+func ParsePackages(r io.Reader) ([]Package, error) {
+	packages := make([]Package, 0)
+	stanza := make(map[string]string)
+	lastKey := ""
+
+	flush := func() {
+		if len(stanza) == 0 {
+			return
+		}
+		size, _ := strconv.ParseInt(stanza["Size"], 10, 64) // defaults to 0 if absent/unparseable
+		packages = append(packages, Package{
+			Package:  stanza["Package"],
+			Version:  stanza["Version"],
+			Filename: stanza["Filename"],
+			SHA256:   stanza["SHA256"],
+			Size:     size,
+		})
+		stanza = make(map[string]string)
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.TrimSpace(line) == "" {
+			flush()
+			lastKey = ""
+			continue
+		}
+
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && lastKey != "" {
+			stanza[lastKey] += "\n" + strings.TrimSpace(line)
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		stanza[key] = strings.TrimSpace(value)
+		lastKey = key
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+/*
+ * ParsePool walks the <a href="..."> entries of an Apache-style directory listing and returns
+ * every .deb it finds, with its name/version/arch split out of the filename
+ * (name_version_arch.deb). A .deb whose filename is not of that form is skipped.
+ */
+func ParsePool(r io.Reader) ([]DebFile, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]DebFile, 0)
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "a" {
+			for _, attr := range n.Attr {
+				if attr.Key != "href" || !strings.HasSuffix(attr.Val, ".deb") {
+					continue
+				}
+				if f, ok := parseDebFilename(attr.Val); ok {
+					files = append(files, f)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return files, nil
+}
+
+// parseDebFilename splits a name_version_arch.deb filename into its parts
+func parseDebFilename(href string) (DebFile, bool) {
+	name := strings.TrimSuffix(path.Base(href), ".deb")
+	parts := strings.Split(name, "_")
+	if len(parts) != 3 {
+		return DebFile{}, false
+	}
+	return DebFile{Name: parts[0], Version: parts[1], Arch: parts[2]}, true
+}
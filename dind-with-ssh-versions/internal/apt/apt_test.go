@@ -0,0 +1,118 @@
+package apt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePackages(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  []Package
+	}{
+		{
+			name: "single stanza",
+			input: "Package: docker-engine\n" +
+				"Version: 1.13.1-0~trusty\n" +
+				"Filename: pool/main/d/docker-engine/docker-engine_1.13.1~trusty_amd64.deb\n" +
+				"SHA256: abc123\n" +
+				"Size: 42\n",
+			want: []Package{{
+				Package:  "docker-engine",
+				Version:  "1.13.1-0~trusty",
+				Filename: "pool/main/d/docker-engine/docker-engine_1.13.1~trusty_amd64.deb",
+				SHA256:   "abc123",
+				Size:     42,
+			}},
+		},
+		{
+			name: "continuation line is folded into the previous key",
+			input: "Package: docker-engine\n" +
+				"Description: a container runtime\n" +
+				" that also does other things\n" +
+				"Version: 1.13.1-0~trusty\n",
+			want: []Package{{
+				Package: "docker-engine",
+				Version: "1.13.1-0~trusty",
+			}},
+		},
+		{
+			name: "stanza missing Filename and SHA256 still parses",
+			input: "Package: docker-engine\n" +
+				"Version: 1.13.1-0~trusty\n",
+			want: []Package{{
+				Package: "docker-engine",
+				Version: "1.13.1-0~trusty",
+			}},
+		},
+		{
+			name: "unparseable Size defaults to zero",
+			input: "Package: docker-engine\n" +
+				"Version: 1.13.1-0~trusty\n" +
+				"Size: not-a-number\n",
+			want: []Package{{
+				Package: "docker-engine",
+				Version: "1.13.1-0~trusty",
+				Size:    0,
+			}},
+		},
+		{
+			name: "multiple stanzas for the same package are all returned",
+			input: "Package: docker-engine\n" +
+				"Version: 1.13.1-0~trusty\n" +
+				"\n" +
+				"Package: docker-engine\n" +
+				"Version: 1.12.6-0~trusty\n",
+			want: []Package{
+				{Package: "docker-engine", Version: "1.13.1-0~trusty"},
+				{Package: "docker-engine", Version: "1.12.6-0~trusty"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParsePackages(strings.NewReader(tc.input))
+			if err != nil {
+				t.Fatalf("ParsePackages: %v", err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d packages, want %d: %+v", len(got), len(tc.want), got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("package %d: got %+v, want %+v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParsePool(t *testing.T) {
+	const html = `<html><body>
+<a href="docker-engine_1.13.1~trusty_amd64.deb">docker-engine_1.13.1~trusty_amd64.deb</a>
+<a href="docker-engine_1.12.6~trusty_amd64.deb">docker-engine_1.12.6~trusty_amd64.deb</a>
+<a href="not-a-deb.txt">not-a-deb.txt</a>
+<a href="malformed.deb">malformed.deb</a>
+<a href="../">Parent Directory</a>
+</body></html>`
+
+	got, err := ParsePool(strings.NewReader(html))
+	if err != nil {
+		t.Fatalf("ParsePool: %v", err)
+	}
+
+	want := []DebFile{
+		{Name: "docker-engine", Version: "1.13.1~trusty", Arch: "amd64"},
+		{Name: "docker-engine", Version: "1.12.6~trusty", Arch: "amd64"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d deb files, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("deb file %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}